@@ -0,0 +1,192 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// blockSize is the suggested size a client should split a file resource
+// into for chunked, resumable, content-addressed transfer; the last
+// block of a file may be shorter. It is only a default for callers that
+// don't have a reason to pick otherwise: the agent always uses the
+// block size declared on the request (see blockOffset), not this
+// constant, since a client is free to split differently.
+const blockSize = 4 * 1024 * 1024 // 4 MiB
+
+// blobDirOf returns the content-addressed blob store for an agent
+// rooted at dir, e.g. "<Dir>/blobs".
+func blobDirOf(dir string) string {
+	return filepath.Join(dir, "blobs")
+}
+
+// blobPath shards blobs by the first two hex characters of their hash
+// so a single directory never ends up with an unreasonable number of
+// entries.
+func blobPath(blobDir, hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(blobDir, hash)
+	}
+	return filepath.Join(blobDir, hash[:2], hash)
+}
+
+func hasBlob(blobDir, hash string) bool {
+	_, err := os.Stat(blobPath(blobDir, hash))
+	return err == nil
+}
+
+// writeBlobAtomic stores data under its content hash, ignoring a
+// concurrent writer that got there first.
+func writeBlobAtomic(blobDir, hash string, data []byte) error {
+	dest := blobPath(blobDir, hash)
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(dest), ".blob-")
+	if err != nil {
+		return err
+	}
+	tempName := tempFile.Name()
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempName)
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	if err := os.Rename(tempName, dest); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	return nil
+}
+
+// linkBlobTo materializes the blob at hash as dest, hardlinking when
+// possible and falling back to a copy across filesystem boundaries.
+func linkBlobTo(blobDir, hash, dest string) error {
+	src := blobPath(blobDir, hash)
+	os.MkdirAll(filepath.Dir(dest), 0755)
+	os.Remove(dest)
+
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// storeFileAsBlob adds an already-written file to the blob store under
+// hash, hardlinking when possible so it costs no extra disk space.
+func storeFileAsBlob(blobDir, hash, filePath string) error {
+	dest := blobPath(blobDir, hash)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(filePath, dest); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// BlobMetrics is a point-in-time snapshot of the agent's file resource
+// transfer counters, for capacity planning.
+type BlobMetrics struct {
+	BytesReceived     int64
+	BytesDeduped      int64
+	BytesDecompressed int64
+}
+
+var (
+	blobBytesReceived     int64
+	blobBytesDeduped      int64
+	blobBytesDecompressed int64
+)
+
+func addBytesReceived(n int64)     { atomic.AddInt64(&blobBytesReceived, n) }
+func addBytesDeduped(n int64)      { atomic.AddInt64(&blobBytesDeduped, n) }
+func addBytesDecompressed(n int64) { atomic.AddInt64(&blobBytesDecompressed, n) }
+
+// BlobMetricsSnapshot reports cumulative file resource transfer counts
+// since the agent started. It backs the Metrics RPC.
+func BlobMetricsSnapshot() BlobMetrics {
+	return BlobMetrics{
+		BytesReceived:     atomic.LoadInt64(&blobBytesReceived),
+		BytesDeduped:      atomic.LoadInt64(&blobBytesDeduped),
+		BytesDecompressed: atomic.LoadInt64(&blobBytesDecompressed),
+	}
+}
+
+// blockOffset computes where block index lands in the whole file, given
+// the block size the sending client actually used to split it. This
+// must come from the client's request rather than the agent's own
+// blockSize constant: the two are not guaranteed to agree, and silently
+// assuming they do would write every block to the wrong offset.
+func blockOffset(index int, clientBlockSize int64) int64 {
+	return int64(index) * clientBlockSize
+}
+
+func blockBitmapPath(tempFile string) string {
+	return fmt.Sprintf("%s.bitmap", tempFile)
+}
+
+// readBlockBitmap loads which of the numBlocks blocks of a
+// previously-interrupted transfer were already durably written to the
+// tempfile, so a retry can resume from the first missing one. A
+// missing or short bitmap file is treated as "nothing written yet".
+func readBlockBitmap(path string, numBlocks int) []bool {
+	have := make([]bool, numBlocks)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return have
+	}
+	for i := 0; i < numBlocks && i < len(data); i++ {
+		have[i] = data[i] == 1
+	}
+	return have
+}
+
+func writeBlockBitmap(path string, have []bool) error {
+	data := make([]byte, len(have))
+	for i, h := range have {
+		if h {
+			data[i] = 1
+		}
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
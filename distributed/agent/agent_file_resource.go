@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/chrislusf/gleam/distributed/resource"
+	"github.com/chrislusf/gleam/pb"
+	"github.com/klauspost/compress/zstd"
+)
+
+// SendFileResource receives a file as a sequence of fixed-size,
+// content-addressed blocks, so that a disconnect only costs the
+// blocks that were not yet acknowledged, not the whole file.
+//
+// Protocol: the first message carries the metadata (destination, whole
+// -file hash, and the hash of every block). The agent replies with
+// which of those blocks it already has in its blob store, and the
+// client then streams only the rest. A previously-interrupted transfer
+// is resumed from its on-disk bitmap rather than starting over.
+func (as *AgentServer) SendFileResource(stream pb.GleamAgent_SendFileResourceServer) error {
+	as.receiveFileResourceLock.Lock()
+	defer as.receiveFileResourceLock.Unlock()
+
+	request, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	dir := path.Join(*as.Option.Dir, fmt.Sprintf("%d", request.GetFlowHashCode()), request.GetDir())
+	os.MkdirAll(dir, 0755)
+	blobDir := blobDirOf(*as.Option.Dir)
+
+	toFile := filepath.Join(dir, request.GetName())
+	wholeHash := request.GetHash()
+
+	// Fast path: we already have a file with these exact bytes, stored
+	// under some other name or flow. Just link it in.
+	if wholeHash != "" && hasBlob(blobDir, wholeHash) {
+		if err := linkBlobTo(blobDir, wholeHash, toFile); err == nil {
+			addBytesDeduped(request.GetSize())
+			return stream.Send(&pb.FileResourceResponse{IsSameContent: true, IsFullyWritten: true})
+		}
+	}
+
+	clientBlockSize := int64(request.GetBlockSize())
+	if clientBlockSize <= 0 {
+		return fmt.Errorf("file resource request for %s did not declare a block size", request.GetName())
+	}
+
+	blockHashes := request.GetBlockHashes()
+	haveFromBlob := make([]bool, len(blockHashes))
+	have := make([]bool, len(blockHashes))
+	for i, h := range blockHashes {
+		haveFromBlob[i] = hasBlob(blobDir, h)
+		have[i] = haveFromBlob[i]
+	}
+
+	tempFile := toFile + ".part"
+	bitmapFile := blockBitmapPath(tempFile)
+	resumed := readBlockBitmap(bitmapFile, len(blockHashes))
+	for i, h := range resumed {
+		if h {
+			have[i] = true
+		}
+	}
+
+	if err := stream.Send(&pb.FileResourceResponse{HaveBlocks: have}); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE, 0755)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// A stale .part from an earlier, longer transfer of a
+	// differently-sized file would otherwise leave trailing bytes past
+	// request.GetSize() in place forever: every block is marked
+	// present on resume, so nothing ever rewrites that tail, and the
+	// whole-file hash check below would then fail on every retry.
+	if err := f.Truncate(request.GetSize()); err != nil {
+		return err
+	}
+
+	for index, hash := range blockHashes {
+		// A block already marked present in the resumed bitmap is
+		// already sitting in the tempfile itself from the earlier,
+		// interrupted attempt: the tempfile is the source of truth for
+		// it, and re-copying from the blob store would wrongly fail the
+		// whole transfer if writeBlobAtomic never made it into the blob
+		// store for that block (its error is deliberately ignored,
+		// since it is only a dedup cache). Only blocks we're relying on
+		// solely for cross-file dedup need to be materialized here.
+		if resumed[index] {
+			continue
+		}
+		if haveFromBlob[index] {
+			if err := copyBlobInto(f, blobDir, hash, blockOffset(index, clientBlockSize)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		blockRequest, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		index := int(blockRequest.GetBlockIndex())
+		if index < 0 || index >= len(blockHashes) {
+			return fmt.Errorf("block index %d out of range for %s", index, request.GetName())
+		}
+
+		content, err := decompress(blockRequest.GetContent(), request.GetCompression())
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != blockHashes[index] {
+			return fmt.Errorf("block %d of %s failed hash verification", index, request.GetName())
+		}
+
+		if _, err := f.WriteAt(content, blockOffset(index, clientBlockSize)); err != nil {
+			return err
+		}
+		writeBlobAtomic(blobDir, blockHashes[index], content)
+
+		addBytesReceived(int64(len(blockRequest.GetContent())))
+		addBytesDecompressed(int64(len(content)))
+
+		have[index] = true
+		writeBlockBitmap(bitmapFile, have)
+	}
+
+	for i, h := range have {
+		if !h {
+			// The client disconnected before sending every missing
+			// block. Leave the tempfile and bitmap in place so a
+			// retry can resume from here instead of starting over.
+			return fmt.Errorf("transfer of %s incomplete: missing block %d", request.GetName(), i)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if wholeHash != "" {
+		finalHash, err := resource.GenerateFileHash(tempFile)
+		if err != nil {
+			return err
+		}
+		if finalHash.Hash != wholeHash {
+			return fmt.Errorf("%s failed whole-file hash verification after all blocks were written", request.GetName())
+		}
+	}
+
+	os.Remove(bitmapFile)
+	if err := os.Rename(tempFile, toFile); err != nil {
+		return err
+	}
+
+	// Cache the whole file too, so a later upload of the same content
+	// under a different name or flow can be linked in directly.
+	if wholeHash != "" && !hasBlob(blobDir, wholeHash) {
+		storeFileAsBlob(blobDir, wholeHash, toFile)
+	}
+
+	return nil
+}
+
+func copyBlobInto(f *os.File, blobDir, hash string, offset int64) error {
+	src, err := os.Open(blobPath(blobDir, hash))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, offset); err != nil {
+		return err
+	}
+	addBytesDeduped(int64(len(data)))
+	return nil
+}
+
+func decompress(content []byte, compression pb.FileResourceRequest_Compression) ([]byte, error) {
+	switch compression {
+	case pb.FileResourceRequest_NONE:
+		return content, nil
+	case pb.FileResourceRequest_ZSTD:
+		decoder, err := zstd.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return io.ReadAll(decoder)
+	default:
+		return nil, fmt.Errorf("unsupported compression %v", compression)
+	}
+}
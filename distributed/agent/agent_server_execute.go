@@ -0,0 +1,612 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/chrislusf/gleam/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/kardianos/osext"
+	"golang.org/x/net/context"
+)
+
+// task is one executor subprocess, tracked from CreateTask through
+// DeleteTask. It buffers the most recent ExecutionResponses it has
+// produced (up to maxBufferedEvents) so that Events can be replayed from
+// any sequence number still buffered, which is what lets a master resume
+// watching a task after a reconnect.
+type task struct {
+	id      string
+	dir     string
+	request *pb.ExecutionRequest
+	pidFile string
+
+	mu               sync.Mutex
+	cond             *sync.Cond
+	cmd              *exec.Cmd
+	started          bool
+	exited           bool
+	events           []*pb.ExecutionResponse
+	droppedEvents    int // events evicted from the front of events, for sequence bookkeeping
+	progress         float64
+	resourceReleased bool
+	killRequested    bool // set by Signal, to tell a deliberate kill apart from an OOM kill
+
+	// streamsDone is released once stdout and stderr have both been
+	// read to EOF. os/exec documents that it is incorrect to call
+	// Wait before those reads complete, since Wait closes the pipes
+	// as soon as the process exits; waitTask blocks on this first.
+	streamsDone sync.WaitGroup
+
+	// redactor masks secrets registered by the executor via
+	// ::gleam-mask:: out of all output produced from then on.
+	redactor *redactor
+}
+
+// maxBufferedEvents bounds how many events a task keeps around to
+// serve Events resume requests. Without a bound, a long, chatty task
+// would grow this slice for its entire lifetime and could OOM the
+// agent; a watcher that falls this far behind loses the oldest
+// history rather than the agent running out of memory.
+const maxBufferedEvents = 10000
+
+func (t *task) appendEvent(event *pb.ExecutionResponse) {
+	t.mu.Lock()
+	t.events = append(t.events, event)
+	if len(t.events) > maxBufferedEvents {
+		evict := len(t.events) - maxBufferedEvents
+		t.events = t.events[evict:]
+		t.droppedEvents += evict
+	}
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+func (t *task) markExited() {
+	t.mu.Lock()
+	t.exited = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// releaseAllocationOnce gives back the ComputeResource that CreateTask
+// allocated for t. It is safe to call more than once (e.g. once from a
+// failed StartTask and again from DeleteTask): only the first call
+// does anything, so the allocation is never double-released and never
+// leaked regardless of which of those paths a task takes.
+func (t *task) releaseAllocationOnce(as *AgentServer) {
+	t.mu.Lock()
+	alreadyReleased := t.resourceReleased
+	t.resourceReleased = true
+	t.mu.Unlock()
+
+	if alreadyReleased {
+		return
+	}
+	if resource := t.request.GetResource(); resource != nil {
+		as.minusAllocated(*resource)
+	}
+}
+
+// eventsFrom sends every event from sequence onward through send, then
+// blocks for more until the task exits or send returns an error. It is
+// shared by the Events RPC and by the backward-compatible Execute RPC.
+//
+// Events are redacted here, at send time, rather than when they are
+// buffered: a ::gleam-mask:: line can arrive after the secret it
+// covers was already appended, and redacting against the current
+// automaton on every send is what lets that still-unsent tail get
+// scrubbed before it ever leaves the agent.
+//
+// If sequence refers to an event that has since been evicted by
+// maxBufferedEvents, replay silently jumps forward to the oldest event
+// still buffered: that history is gone, and the caller is not told
+// about the gap, since the events sent carry no sequence number.
+func (t *task) eventsFrom(sequence int, send func(*pb.ExecutionResponse) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for {
+		for {
+			// Re-clamped on every iteration, not just on entry: send
+			// below unlocks t.mu, so appendEvent can evict enough
+			// events in the meantime to push droppedEvents past
+			// sequence. Without re-checking here, the index below would
+			// go negative and panic.
+			if sequence < t.droppedEvents {
+				sequence = t.droppedEvents
+			}
+			if sequence-t.droppedEvents >= len(t.events) {
+				break
+			}
+			event := t.redactor.redactEvent(t.events[sequence-t.droppedEvents])
+			sequence++
+			t.mu.Unlock()
+			err := send(event)
+			t.mu.Lock()
+			if err != nil {
+				return err
+			}
+		}
+		if t.exited {
+			return nil
+		}
+		t.cond.Wait()
+	}
+}
+
+// taskManager is the agent-wide table of in-flight tasks. It is
+// intentionally process-local: a restarted agent relies on the pid
+// files under its Dir, not this table, to reap orphans.
+type taskManager struct {
+	mu      sync.Mutex
+	tasks   map[string]*task
+	counter uint64
+}
+
+var tasks = &taskManager{tasks: make(map[string]*task)}
+
+func (tm *taskManager) create(dir string, request *pb.ExecutionRequest) *task {
+	id := fmt.Sprintf("%d-%d", os.Getpid(), atomic.AddUint64(&tm.counter, 1))
+	t := &task{
+		id:       id,
+		dir:      dir,
+		request:  request,
+		pidFile:  filepath.Join(dir, ".gleam-task.pid"),
+		redactor: newRedactor(),
+	}
+	t.cond = sync.NewCond(&t.mu)
+
+	tm.mu.Lock()
+	tm.tasks[id] = t
+	tm.mu.Unlock()
+	return t
+}
+
+func (tm *taskManager) get(taskId string) (*task, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t, ok := tm.tasks[taskId]
+	return t, ok
+}
+
+func (tm *taskManager) delete(taskId string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	delete(tm.tasks, taskId)
+}
+
+// CreateTask allocates the working dir and resources for an execution
+// and registers it under a server-assigned task id, without starting
+// anything yet.
+func (as *AgentServer) CreateTask(ctx context.Context, request *pb.CreateTaskRequest) (*pb.CreateTaskResponse, error) {
+
+	execution := request.GetExecution()
+	dir := path.Join(*as.Option.Dir, fmt.Sprintf("%d", execution.GetInstructions().GetFlowHashCode()), execution.GetDir())
+	os.MkdirAll(dir, 0755)
+
+	allocated := *execution.GetResource()
+	as.plusAllocated(allocated)
+
+	t := tasks.create(dir, execution)
+
+	return &pb.CreateTaskResponse{
+		TaskId: t.id,
+	}, nil
+}
+
+// StartTask forks the executor subprocess for a previously created task
+// and returns as soon as it has started, without waiting for it to exit.
+func (as *AgentServer) StartTask(ctx context.Context, request *pb.StartTaskRequest) (*pb.StartTaskResponse, error) {
+
+	t, ok := tasks.get(request.GetTaskId())
+	if !ok {
+		return nil, fmt.Errorf("task %s not found", request.GetTaskId())
+	}
+
+	t.mu.Lock()
+	if t.started {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("task %s already started", t.id)
+	}
+	t.started = true
+	t.mu.Unlock()
+
+	executableFullFilename, _ := osext.Executable()
+	command := exec.Command(
+		executableFullFilename,
+		"execute",
+		"--note",
+		t.request.GetName(),
+	)
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		t.releaseAllocationOnce(as)
+		return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
+	}
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		t.releaseAllocationOnce(as)
+		return nil, fmt.Errorf("failed to create stdout pipe: %v", err)
+	}
+	stderr, err := command.StderrPipe()
+	if err != nil {
+		t.releaseAllocationOnce(as)
+		return nil, fmt.Errorf("failed to create stderr pipe: %v", err)
+	}
+	command.Dir = t.dir
+
+	if err := command.Start(); err != nil {
+		log.Printf("Failed to start command %s under %s: %v", command.Path, command.Dir, err)
+		t.releaseAllocationOnce(as)
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.cmd = command
+	t.mu.Unlock()
+	ioutil.WriteFile(t.pidFile, []byte(strconv.Itoa(command.Process.Pid)), 0644)
+
+	t.appendEvent(&pb.ExecutionResponse{Started: true})
+
+	t.streamsDone.Add(2)
+	go func() {
+		defer t.streamsDone.Done()
+		streamOutputToTask(t, stdout)
+	}()
+	go func() {
+		defer t.streamsDone.Done()
+		streamErrorToTask(t, stderr)
+	}()
+	go streamPulseToTask(t)
+
+	// The process is running from here on, so waitTask (and the
+	// allocation release it does once the process exits) must run no
+	// matter what happens below: the task is never left to hold its
+	// ComputeResource allocation forever just because writing its
+	// instructions failed.
+	go as.waitTask(t)
+
+	msgMessageBytes, err := proto.Marshal(t.request.GetInstructions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal command %s: %v", t.request.GetInstructions().String(), err)
+	}
+	if _, err := stdin.Write(msgMessageBytes); err != nil {
+		return nil, fmt.Errorf("failed to write command: %v", err)
+	}
+	if err := stdin.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close command: %v", err)
+	}
+
+	return &pb.StartTaskResponse{}, nil
+}
+
+// waitTask runs in the background for the lifetime of the subprocess
+// and records the Exited event once it is reaped, independent of
+// whether anyone is currently watching Events. It does not reap the
+// process until streamOutputToTask/streamErrorToTask have both seen
+// EOF, since calling Wait earlier would race the pipe reads.
+func (as *AgentServer) waitTask(t *task) {
+	t.streamsDone.Wait()
+
+	waitErr := t.cmd.Wait()
+	if waitErr != nil {
+		log.Printf("Failed to run command %s: %v", t.request.GetName(), waitErr)
+	}
+
+	if t.wasOOMKilled() {
+		t.appendEvent(&pb.ExecutionResponse{OOMKilled: true})
+	}
+
+	event := &pb.ExecutionResponse{Exited: true}
+	if t.cmd.ProcessState != nil {
+		event.SystemTime = t.cmd.ProcessState.SystemTime().Seconds()
+		event.UserTime = t.cmd.ProcessState.UserTime().Seconds()
+	}
+	if waitErr != nil {
+		event.Error = []byte(waitErr.Error())
+	}
+	t.appendEvent(event)
+	t.markExited()
+
+	t.releaseAllocationOnce(as)
+}
+
+// wasOOMKilled is a best-effort heuristic: a process killed by SIGKILL
+// that nobody asked this agent to kill via Signal is most likely the
+// kernel OOM killer, since that is by far the most common source of an
+// unsolicited SIGKILL against a running executor.
+func (t *task) wasOOMKilled() bool {
+	if t.cmd.ProcessState == nil {
+		return false
+	}
+	status, ok := t.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || status.Signal() != syscall.SIGKILL {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.killRequested
+}
+
+// Wait blocks until the task's subprocess has exited and returns its
+// exit stats.
+func (as *AgentServer) Wait(ctx context.Context, request *pb.WaitTaskRequest) (*pb.WaitTaskResponse, error) {
+	t, ok := tasks.get(request.GetTaskId())
+	if !ok {
+		return nil, fmt.Errorf("task %s not found", request.GetTaskId())
+	}
+
+	t.mu.Lock()
+	for !t.exited {
+		t.cond.Wait()
+	}
+	cmd := t.cmd
+	t.mu.Unlock()
+
+	response := &pb.WaitTaskResponse{}
+	if cmd != nil && cmd.ProcessState != nil {
+		response.SystemTime = cmd.ProcessState.SystemTime().Seconds()
+		response.UserTime = cmd.ProcessState.UserTime().Seconds()
+		response.ExitCode = int32(cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus())
+	}
+	return response, nil
+}
+
+// Events streams every stdout/stderr/typed event produced by a task,
+// starting from request.GetSequence(), and keeps streaming new ones
+// until the task exits. Sequence numbers count from 0 and the event at
+// request.GetSequence() is included, so a master that reconnects calls
+// Events again with the number of events it has already received.
+func (as *AgentServer) Events(request *pb.EventsRequest, stream pb.GleamAgent_EventsServer) error {
+	t, ok := tasks.get(request.GetTaskId())
+	if !ok {
+		return fmt.Errorf("task %s not found", request.GetTaskId())
+	}
+
+	return t.eventsFrom(int(request.GetSequence()), func(event *pb.ExecutionResponse) error {
+		return stream.Send(event)
+	})
+}
+
+// Signal sends a unix signal to a running task's subprocess without
+// disturbing any in-progress Events stream.
+func (as *AgentServer) Signal(ctx context.Context, request *pb.SignalRequest) (*pb.SignalResponse, error) {
+	t, ok := tasks.get(request.GetTaskId())
+	if !ok {
+		return nil, fmt.Errorf("task %s not found", request.GetTaskId())
+	}
+
+	t.mu.Lock()
+	cmd := t.cmd
+	t.mu.Unlock()
+	if cmd == nil || cmd.Process == nil {
+		return nil, fmt.Errorf("task %s has not started", t.id)
+	}
+
+	sig := syscall.SIGTERM
+	if request.GetForce() {
+		sig = syscall.SIGKILL
+	}
+
+	// Record that a kill was deliberately requested before sending it,
+	// so waitTask can tell this apart from an unsolicited SIGKILL (the
+	// OOM killer) once the process exits.
+	if sig == syscall.SIGKILL {
+		t.mu.Lock()
+		t.killRequested = true
+		t.mu.Unlock()
+	}
+
+	if err := cmd.Process.Signal(sig); err != nil {
+		return nil, err
+	}
+	return &pb.SignalResponse{}, nil
+}
+
+// DeleteTask removes the task's bookkeeping and its pid file. It does
+// not touch the working dir itself, since that may still hold output
+// the caller wants.
+func (as *AgentServer) DeleteTask(ctx context.Context, request *pb.DeleteTaskRequest) (*pb.DeleteTaskResponse, error) {
+	t, ok := tasks.get(request.GetTaskId())
+	if !ok {
+		return &pb.DeleteTaskResponse{}, nil
+	}
+
+	// A task can be deleted before it ever exited (created but never
+	// started, or started and then abandoned); make sure its
+	// ComputeResource allocation is given back either way.
+	t.releaseAllocationOnce(as)
+
+	os.Remove(t.pidFile)
+	tasks.delete(request.GetTaskId())
+
+	return &pb.DeleteTaskResponse{}, nil
+}
+
+// Execute is kept for callers that have not moved to the
+// Create/Start/Events/Wait/Delete lifecycle yet. It simply drives that
+// lifecycle end to end over a single stream.
+func (as *AgentServer) Execute(request *pb.ExecutionRequest, stream pb.GleamAgent_ExecuteServer) error {
+
+	createResponse, err := as.CreateTask(stream.Context(), &pb.CreateTaskRequest{Execution: request})
+	if err != nil {
+		return err
+	}
+	taskId := createResponse.GetTaskId()
+	defer as.DeleteTask(stream.Context(), &pb.DeleteTaskRequest{TaskId: taskId})
+
+	if _, err := as.StartTask(stream.Context(), &pb.StartTaskRequest{TaskId: taskId}); err != nil {
+		return err
+	}
+
+	t, _ := tasks.get(taskId)
+	if err := t.eventsFrom(0, func(event *pb.ExecutionResponse) error {
+		return stream.Send(event)
+	}); err != nil {
+		return err
+	}
+
+	_, err = as.Wait(stream.Context(), &pb.WaitTaskRequest{TaskId: taskId})
+	return err
+}
+
+// maxWorkflowCommandLineLength bounds how long a line can be while
+// still being checked for a ::gleam-*:: workflow command. It only
+// needs to comfortably fit a mask value or a summary, not arbitrary
+// script output.
+const maxWorkflowCommandLineLength = 64 * 1024
+
+// streamLinesToTask scans reader line by line and appends one event per
+// line via makeEvent, falling back to raw passthrough once a line
+// exceeds maxWorkflowCommandLineLength. Scanning by line, rather than by
+// a fixed-size read, matters for more than workflow commands: a mask
+// registered later is applied to a whole buffered line at send time, so
+// a secret that happened to straddle a read boundary would otherwise
+// never match.
+//
+// This is built on bufio.Reader rather than bufio.Scanner on purpose:
+// Scanner's ErrTooLong silently discards both the over-long token and
+// whatever it had already buffered past it, which would drop output.
+// Accumulating with ReadSlice instead means every byte pulled off the
+// wire is still handed to makeEvent even once a line overflows.
+func streamLinesToTask(t *task, reader io.Reader, isWorkflowCommand func([]byte) bool, makeEvent func([]byte) *pb.ExecutionResponse) {
+	bufReader := bufio.NewReaderSize(reader, 4096)
+
+	var line []byte
+	for {
+		chunk, err := bufReader.ReadSlice('\n')
+		line = append(line, chunk...)
+
+		if err == bufio.ErrBufferFull {
+			if len(line) < maxWorkflowCommandLineLength {
+				continue
+			}
+			// This line was never going to be a workflow command; stop
+			// trying to parse commands and copy the rest of the stream
+			// straight through, starting with what has already been
+			// read for this line.
+			t.appendEvent(makeEvent(line))
+			copyRawToTask(t, bufReader, makeEvent)
+			return
+		}
+
+		complete := err == nil
+		toCheck := line
+		if complete {
+			toCheck = line[:len(line)-1]
+		}
+		if len(line) > 0 && (isWorkflowCommand == nil || !isWorkflowCommand(toCheck)) {
+			if complete {
+				t.appendEvent(makeEvent(line))
+			} else {
+				t.appendEvent(makeEvent(append(append([]byte{}, line...), '\n')))
+			}
+		}
+
+		if err != nil {
+			return
+		}
+		line = nil
+	}
+}
+
+func copyRawToTask(t *task, reader io.Reader, makeEvent func([]byte) *pb.ExecutionResponse) {
+	buffer := make([]byte, 4096)
+	for {
+		n, err := reader.Read(buffer)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buffer[:n])
+			t.appendEvent(makeEvent(chunk))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// streamOutputToTask reads the executor's stdout line by line, looking
+// for the ::gleam-*:: workflow commands described in util.MaskSecret
+// and friends. Lines that aren't a workflow command are buffered as a
+// normal Output event; redaction happens later, at send time.
+func streamOutputToTask(t *task, reader io.Reader) {
+	streamLinesToTask(t, reader, t.handleWorkflowCommand, func(line []byte) *pb.ExecutionResponse {
+		return &pb.ExecutionResponse{Output: line}
+	})
+}
+
+func streamErrorToTask(t *task, reader io.Reader) {
+	// No tee to the agent's own os.Stderr here: that would write the
+	// executor's raw stderr before it ever passes through the redactor,
+	// which runs at send time in eventsFrom, leaking a masked secret
+	// into the agent's own logs.
+	streamLinesToTask(t, reader, nil, func(line []byte) *pb.ExecutionResponse {
+		return &pb.ExecutionResponse{Error: line}
+	})
+}
+
+func streamPulseToTask(t *task) {
+	tickChan := time.NewTicker(time.Minute).C
+	for {
+		<-tickChan
+		t.mu.Lock()
+		exited := t.exited
+		progress := t.progress
+		t.mu.Unlock()
+		if exited {
+			return
+		}
+		t.appendEvent(&pb.ExecutionResponse{Pulse: true, Progress: progress})
+	}
+}
+
+// ReapOrphanTasks scans dir for pid files left behind by an agent that
+// restarted mid-task, and kills the processes they reference. It should
+// be called once from the agent's startup path, before it starts
+// accepting new tasks.
+func ReapOrphanTasks(dir string) error {
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Base(name) != ".gleam-task.pid" {
+			return nil
+		}
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil
+		}
+		pid, err := strconv.Atoi(string(content))
+		if err != nil {
+			return nil
+		}
+		if process, err := os.FindProcess(pid); err == nil {
+			process.Signal(syscall.SIGKILL)
+		}
+		os.Remove(name)
+		return nil
+	})
+}
+
+func (as *AgentServer) plusAllocated(allocated pb.ComputeResource) {
+	as.allocatedResourceLock.Lock()
+	defer as.allocatedResourceLock.Unlock()
+	*as.allocatedResource = as.allocatedResource.Plus(allocated)
+}
+
+func (as *AgentServer) minusAllocated(allocated pb.ComputeResource) {
+	as.allocatedResourceLock.Lock()
+	defer as.allocatedResourceLock.Unlock()
+	*as.allocatedResource = as.allocatedResource.Minus(allocated)
+}
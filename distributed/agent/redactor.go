@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/chrislusf/gleam/pb"
+)
+
+// redactor is an Aho-Corasick automaton over the secret values
+// registered via ::gleam-mask::. It lets a chunk of output be scanned
+// for every registered secret in a single O(n+matches) pass, rather
+// than one pass per secret.
+type redactor struct {
+	mu       sync.RWMutex
+	patterns []string
+	root     *acNode
+}
+
+type acNode struct {
+	children map[byte]*acNode
+	fail     *acNode
+	// maxLen is the length of the longest registered pattern that ends
+	// at this node, either directly or via a suffix link. 0 means none.
+	maxLen int
+}
+
+func newACNode() *acNode {
+	return &acNode{children: make(map[byte]*acNode)}
+}
+
+func newRedactor() *redactor {
+	return &redactor{}
+}
+
+// add registers a new value to be redacted. Already-buffered events
+// that have not been sent yet will still pick up the new pattern,
+// because callers redact against the current automaton at send time
+// (see task.eventsFrom / redactEvent), not when an event is buffered.
+func (r *redactor) add(value string) {
+	if value == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.patterns {
+		if p == value {
+			return
+		}
+	}
+	r.patterns = append(r.patterns, value)
+	r.root = buildAhoCorasick(r.patterns)
+}
+
+// redact replaces every occurrence of a registered pattern in data with
+// "***". Overlapping matches are resolved greedily: once a match ends,
+// scanning resumes right after it.
+func (r *redactor) redact(data []byte) []byte {
+	r.mu.RLock()
+	root := r.root
+	r.mu.RUnlock()
+	if root == nil {
+		return data
+	}
+
+	var out []byte
+	n := root
+	lastCopied := 0
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		for n != root {
+			if _, ok := n.children[c]; ok {
+				break
+			}
+			n = n.fail
+		}
+		if next, ok := n.children[c]; ok {
+			n = next
+		}
+		if n.maxLen > 0 {
+			matchStart := i + 1 - n.maxLen
+			if matchStart < lastCopied {
+				matchStart = lastCopied
+			}
+			out = append(out, data[lastCopied:matchStart]...)
+			out = append(out, '*', '*', '*')
+			lastCopied = i + 1
+			n = root
+		}
+	}
+	out = append(out, data[lastCopied:]...)
+	return out
+}
+
+// redactEvent returns a copy of event with every byte/string field
+// that can carry executor output run through redact. event itself is
+// left untouched, since it is also the copy kept in task.events for
+// any later reader.
+func (r *redactor) redactEvent(event *pb.ExecutionResponse) *pb.ExecutionResponse {
+	if event == nil {
+		return nil
+	}
+	redacted := *event
+
+	if len(event.Output) > 0 {
+		redacted.Output = r.redact(event.Output)
+	}
+	if len(event.Error) > 0 {
+		redacted.Error = r.redact(event.Error)
+	}
+	if len(event.Summary) > 0 {
+		redacted.Summary = r.redact(event.Summary)
+	}
+	if len(event.Outputs) > 0 {
+		outputs := make(map[string]string, len(event.Outputs))
+		for name, value := range event.Outputs {
+			outputs[name] = string(r.redact([]byte(value)))
+		}
+		redacted.Outputs = outputs
+	}
+
+	return &redacted
+}
+
+func buildAhoCorasick(patterns []string) *acNode {
+	root := newACNode()
+	for _, p := range patterns {
+		n := root
+		for i := 0; i < len(p); i++ {
+			c := p[i]
+			child, ok := n.children[c]
+			if !ok {
+				child = newACNode()
+				n.children[c] = child
+			}
+			n = child
+		}
+		if len(p) > n.maxLen {
+			n.maxLen = len(p)
+		}
+	}
+
+	queue := make([]*acNode, 0, len(root.children))
+	for _, child := range root.children {
+		child.fail = root
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for c, child := range n.children {
+			fail := n.fail
+			for fail != nil {
+				if next, ok := fail.children[c]; ok {
+					child.fail = next
+					break
+				}
+				fail = fail.fail
+			}
+			if child.fail == nil {
+				child.fail = root
+			}
+			if child.fail.maxLen > child.maxLen {
+				child.maxLen = child.fail.maxLen
+			}
+			queue = append(queue, child)
+		}
+	}
+	return root
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/chrislusf/gleam/pb"
+)
+
+const (
+	maskCommandPrefix      = "::gleam-mask::"
+	setOutputCommandPrefix = "::gleam-set-output "
+	summaryCommandPrefix   = "::gleam-summary::"
+	progressCommandPrefix  = "::gleam-progress::frac="
+)
+
+// handleWorkflowCommand recognizes the sentinel lines a user script can
+// print to talk back to the agent (see util.MaskSecret and friends). It
+// returns true if line was a workflow command and should not be
+// forwarded as raw output.
+func (t *task) handleWorkflowCommand(line []byte) bool {
+	s := string(line)
+
+	switch {
+	case strings.HasPrefix(s, maskCommandPrefix):
+		t.redactor.add(strings.TrimPrefix(s, maskCommandPrefix))
+		return true
+
+	case strings.HasPrefix(s, setOutputCommandPrefix):
+		rest := strings.TrimPrefix(s, setOutputCommandPrefix)
+		nameAndValue := strings.SplitN(rest, "::", 2)
+		if len(nameAndValue) != 2 || !strings.HasPrefix(nameAndValue[0], "name=") {
+			return false
+		}
+		name := strings.TrimPrefix(nameAndValue[0], "name=")
+		t.appendOutput(name, nameAndValue[1])
+		return true
+
+	case strings.HasPrefix(s, summaryCommandPrefix):
+		t.appendSummary(strings.TrimPrefix(s, summaryCommandPrefix))
+		return true
+
+	case strings.HasPrefix(s, progressCommandPrefix):
+		if frac, err := strconv.ParseFloat(strings.TrimPrefix(s, progressCommandPrefix), 64); err == nil {
+			t.setProgress(frac)
+		}
+		return true
+	}
+
+	return false
+}
+
+// appendOutput and appendSummary buffer the raw value; like stdout and
+// stderr, redaction is applied at send time in eventsFrom so a mask
+// registered after this value was captured still takes effect.
+func (t *task) appendOutput(name, value string) {
+	t.appendEvent(&pb.ExecutionResponse{Outputs: map[string]string{name: value}})
+}
+
+func (t *task) appendSummary(summary string) {
+	t.appendEvent(&pb.ExecutionResponse{Summary: []byte(summary)})
+}
+
+func (t *task) setProgress(fraction float64) {
+	t.mu.Lock()
+	t.progress = fraction
+	t.mu.Unlock()
+}
@@ -0,0 +1,54 @@
+package resource
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// BlockHash is the content hash of one fixed-size block of a file.
+type BlockHash struct {
+	Index int
+	Hash  string
+	Size  int
+}
+
+// GenerateBlockHashes streams through name once, splitting it into
+// blockSize-sized blocks (the last one may be shorter) and hashing each
+// one, while also accumulating the whole-file hash over the same pass.
+func GenerateBlockHashes(name string, blockSize int) (blocks []BlockHash, whole FileHash, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, FileHash{}, err
+	}
+	defer f.Close()
+
+	wholeHasher := sha256.New()
+	buffer := make([]byte, blockSize)
+	var totalSize int64
+
+	for index := 0; ; index++ {
+		n, readErr := io.ReadFull(f, buffer)
+		if n > 0 {
+			wholeHasher.Write(buffer[:n])
+			totalSize += int64(n)
+
+			blockHasher := sha256.New()
+			blockHasher.Write(buffer[:n])
+			blocks = append(blocks, BlockHash{
+				Index: index,
+				Hash:  hex.EncodeToString(blockHasher.Sum(nil)),
+				Size:  n,
+			})
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return nil, FileHash{}, readErr
+		}
+	}
+
+	return blocks, FileHash{Hash: hex.EncodeToString(wholeHasher.Sum(nil)), Size: totalSize}, nil
+}
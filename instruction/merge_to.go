@@ -1,6 +1,7 @@
 package instruction
 
 import (
+	"container/heap"
 	"io"
 	"log"
 
@@ -11,16 +12,18 @@ import (
 func init() {
 	InstructionRunner.Register(func(m *pb.Instruction) Instruction {
 		if m.GetMergeTo() != nil {
-			return NewMergeTo()
+			return NewMergeTo(m.GetMergeTo().GetOrderBys())
 		}
 		return nil
 	})
 }
 
-type MergeTo struct{}
+type MergeTo struct {
+	orderBys []*pb.OrderBy
+}
 
-func NewMergeTo() *MergeTo {
-	return &MergeTo{}
+func NewMergeTo(orderBys []*pb.OrderBy) *MergeTo {
+	return &MergeTo{orderBys: orderBys}
 }
 
 func (b *MergeTo) Name() string {
@@ -29,36 +32,116 @@ func (b *MergeTo) Name() string {
 
 func (b *MergeTo) Function() func(readers []io.Reader, writers []io.Writer, stats *Stats) error {
 	return func(readers []io.Reader, writers []io.Writer, stats *Stats) error {
-		return DoMergeTo(readers, writers[0])
+		return DoMergeTo(readers, writers[0], b.orderBys)
 	}
 }
 
 func (b *MergeTo) SerializeToCommand() *pb.Instruction {
 	return &pb.Instruction{
-		Name:    b.Name(),
-		MergeTo: &pb.Instruction_MergeTo{},
+		Name: b.Name(),
+		MergeTo: &pb.Instruction_MergeTo{
+			OrderBys: b.orderBys,
+		},
 	}
 }
 
 func (b *MergeTo) GetMemoryCostInMB(partitionSize int64) int64 {
-	return 3
+	// one buffered row per reader is kept in the heap at a time
+	return 3 + partitionSize/1024/1024
+}
+
+// mergeHeapItem holds the current row read from one reader, so the
+// heap can pick the smallest row across all readers without re-reading.
+type mergeHeapItem struct {
+	row         *util.Row
+	readerIndex int
+}
+
+type mergeHeap struct {
+	items    []*mergeHeapItem
+	orderBys []*pb.OrderBy
 }
 
-// Top streamingly compare and get the top n items
-func DoMergeTo(readers []io.Reader, writer io.Writer) error {
-	// enqueue one item to the pq from each channel
-	for _, reader := range readers {
-		x, err := util.ReadMessage(reader)
-		for err == nil {
-			if err := util.WriteMessage(writer, x); err != nil {
-				return err
-			}
-			x, err = util.ReadMessage(reader)
+func (h mergeHeap) Len() int { return len(h.items) }
+func (h mergeHeap) Less(i, j int) bool {
+	if isLess := util.LessThan(h.orderBys, h.items[i].row.K, h.items[j].row.K); isLess {
+		return true
+	}
+	if isLess := util.LessThan(h.orderBys, h.items[j].row.K, h.items[i].row.K); isLess {
+		return false
+	}
+	// equal keys: preserve reader order
+	return h.items[i].readerIndex < h.items[j].readerIndex
+}
+func (h mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *mergeHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(*mergeHeapItem))
+}
+func (h *mergeHeap) Pop() interface{} {
+	old := h.items
+	n := len(old)
+	item := old[n-1]
+	h.items = old[:n-1]
+	return item
+}
+
+// DoMergeTo streamingly merges several already-sorted readers into one
+// sorted output, using orderBys as the comparison key. It is a true
+// k-way merge: it keeps at most len(readers) rows buffered at a time,
+// always emitting the smallest one next.
+func DoMergeTo(readers []io.Reader, writer io.Writer, orderBys []*pb.OrderBy) error {
+	if len(readers) == 1 {
+		return copyAll(readers[0], writer)
+	}
+
+	h := &mergeHeap{orderBys: orderBys}
+	heap.Init(h)
+
+	for readerIndex, reader := range readers {
+		row, err := util.ReadRow(reader)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			log.Printf("DoMergeTo failed to read from reader %d: %v", readerIndex, err)
+			return err
+		}
+		heap.Push(h, &mergeHeapItem{row: row, readerIndex: readerIndex})
+	}
+
+	for h.Len() > 0 {
+		top := heap.Pop(h).(*mergeHeapItem)
+		if err := util.WriteRow(writer, top.row); err != nil {
+			return err
+		}
+
+		nextRow, err := util.ReadRow(readers[top.readerIndex])
+		if err == io.EOF {
+			continue
 		}
-		if err != io.EOF {
-			log.Printf("DoMergeTo failed start :%v", err)
+		if err != nil {
+			log.Printf("DoMergeTo failed to read from reader %d: %v", top.readerIndex, err)
 			return err
 		}
+		heap.Push(h, &mergeHeapItem{row: nextRow, readerIndex: top.readerIndex})
+	}
+
+	return nil
+}
+
+// copyAll is the fast path for a single reader: there is nothing to
+// compare, so just stream the messages through unchanged.
+func copyAll(reader io.Reader, writer io.Writer) error {
+	x, err := util.ReadMessage(reader)
+	for err == nil {
+		if err := util.WriteMessage(writer, x); err != nil {
+			return err
+		}
+		x, err = util.ReadMessage(reader)
+	}
+	if err != io.EOF {
+		log.Printf("DoMergeTo failed: %v", err)
+		return err
 	}
 	return nil
 }
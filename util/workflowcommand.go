@@ -0,0 +1,41 @@
+package util
+
+import "fmt"
+
+// The functions here emit "workflow commands": sentinel lines on stdout
+// that the gleam agent recognizes and strips out of the streamed output
+// instead of forwarding them verbatim. A user script imports this
+// package to talk back to the agent without needing to know the wire
+// format.
+//
+// Call MaskSecret before a value is ever printed elsewhere: the agent
+// redacts output when it sends it, so output it already sent before the
+// mask was registered is not redacted.
+
+// MaskSecret tells the agent to replace every later occurrence of value
+// in the output stream with "***".
+func MaskSecret(value string) {
+	if value == "" {
+		return
+	}
+	fmt.Printf("::gleam-mask::%s\n", value)
+}
+
+// SetOutput records a named output value, surfaced on
+// pb.ExecutionResponse.Outputs instead of the raw output stream.
+func SetOutput(name, value string) {
+	fmt.Printf("::gleam-set-output name=%s::%s\n", name, value)
+}
+
+// SetSummary records a human-readable summary of the run, surfaced on
+// pb.ExecutionResponse.Summary instead of the raw output stream.
+func SetSummary(summary string) {
+	fmt.Printf("::gleam-summary::%s\n", summary)
+}
+
+// SetProgress reports how far along the run is, as a fraction between
+// 0 and 1. It is pulsed back to the master on the agent's existing
+// heartbeat interval rather than on every call.
+func SetProgress(fraction float64) {
+	fmt.Printf("::gleam-progress::frac=%v\n", fraction)
+}